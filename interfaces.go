@@ -31,6 +31,19 @@ type SessionHandler interface {
 	MaxMessageSize() uint64
 }
 
+// PasswordVerifierLookup is an optional extension of SessionHandler for
+// servers that want to offer the SCRAMSHA256 mechanism. If a SessionHandler
+// implements it, SCRAMSHA256 asserts for it while negotiating and uses it
+// to fetch verifier material instead of calling Authenticate, so the
+// cleartext password never crosses the wire or needs to be known server
+// side. SessionHandlers that do not implement it simply cannot offer
+// SCRAM-SHA-256; see Server.AuthMechanisms.
+type PasswordVerifierLookup interface {
+	// LookupPasswordVerifier returns the SCRAM-SHA-256 verifier material
+	// for username.
+	LookupPasswordVerifier(username string) (SASLCredential, error)
+}
+
 // MessageHandler is an object providing callbacks for handling a single message
 // within an SMTP session that can contain multiple messages.
 type MessageHandler interface {
@@ -42,3 +55,17 @@ type MessageHandler interface {
 	// AND the 'Close' call succeed.
 	GetDataWriter() (io.WriteCloser, error)
 }
+
+// PerRecipientMessageHandler is an optional extension of MessageHandler for
+// servers running in LMTP mode (see Server.LMTP). If a MessageHandler
+// implements it, handleDATA reports its returned statuses -- one per
+// recipient, in the order they were added via AddRecipient -- instead of a
+// single reply, as required by RFC 2033.
+type PerRecipientMessageHandler interface {
+	MessageHandler
+
+	// DeliverPerRecipient is called once the message data has been
+	// received in full, and returns one status per recipient added to the
+	// envelope, reporting whether delivery to each succeeded.
+	DeliverPerRecipient() []*ReportableStatus
+}
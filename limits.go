@@ -0,0 +1,90 @@
+package yetanothersmtpd
+
+import (
+	"bytes"
+	"io"
+)
+
+// lineLimitReader wraps an io.Reader and fails with ErrLineTooLong once more
+// than 'max' bytes have been seen since the last '\n', so a client that
+// never terminates a line cannot make the server buffer it unboundedly. On
+// overflow it discards the remainder of the offending line itself, from the
+// underlying reader, before returning the error; this way the caller's
+// bufio.Reader never buffers a complete oversize line (and so never
+// dispatches it). Any bytes already read past the line's terminator --
+// e.g. a pipelined command queued right behind it -- are kept and handed
+// back on the next Read, so the stream stays in sync for whatever follows.
+//
+// The cap only applies to command lines: a session disables it for the
+// duration of a DATA/BDAT transfer, since message bodies routinely contain
+// lines, or arbitrary binary, longer than any sane command-line limit.
+type lineLimitReader struct {
+	r       io.Reader
+	max     int
+	cur     int
+	enabled bool
+	pending []byte
+}
+
+func newLineLimitReader(r io.Reader, max int) *lineLimitReader {
+	return &lineLimitReader{r: r, max: max, enabled: true}
+}
+
+// setEnabled toggles whether the line-length cap is enforced; sessions
+// disable it while streaming DATA/BDAT payload and re-enable it once back
+// to reading commands.
+func (l *lineLimitReader) setEnabled(enabled bool) {
+	l.enabled = enabled
+	l.cur = 0
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	if len(l.pending) > 0 {
+		n := copy(p, l.pending)
+		l.pending = l.pending[n:]
+		return n, nil
+	}
+	if !l.enabled {
+		return l.r.Read(p)
+	}
+	n, err := l.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			l.cur = 0
+			continue
+		}
+		l.cur++
+		if l.cur > l.max {
+			trailing, discardErr := l.discardLine(p[i+1 : n])
+			if discardErr != nil {
+				return 0, discardErr
+			}
+			l.pending = trailing
+			return 0, ErrLineTooLong
+		}
+	}
+	return n, err
+}
+
+// discardLine consumes bytes from l.r, starting with any already read into
+// rest, until it sees the line terminator, without ever handing them back
+// to the caller. It returns any bytes read past the terminator, which
+// belong to whatever follows the oversize line and must still reach the
+// caller.
+func (l *lineLimitReader) discardLine(rest []byte) ([]byte, error) {
+	if idx := bytes.IndexByte(rest, '\n'); idx >= 0 {
+		l.cur = 0
+		return append([]byte(nil), rest[idx+1:]...), nil
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := l.r.Read(buf)
+		if idx := bytes.IndexByte(buf[:n], '\n'); idx >= 0 {
+			l.cur = 0
+			return append([]byte(nil), buf[idx+1:n]...), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package yetanothersmtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocolMode controls whether Server.Serve expects a PROXY protocol
+// header to precede the SMTP conversation on each accepted connection, as
+// inserted by an L4 load balancer such as HAProxy or an AWS/GCP network
+// load balancer.
+type ProxyProtocolMode int
+
+const (
+	// ProxyProtocolOff disables PROXY protocol support. This is the default.
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// ProxyProtocolV1 requires the human-readable v1 header on every
+	// connection.
+	ProxyProtocolV1
+	// ProxyProtocolV2 requires the binary v2 header on every connection.
+	ProxyProtocolV2
+	// ProxyProtocolEither accepts either the v1 or v2 header, detected from
+	// the first bytes received.
+	ProxyProtocolEither
+)
+
+// maxProxyHeaderLength bounds the length of a v1 header line and of a v2
+// address block (which follows the fixed 16-byte v2 header), so a client
+// that never sends a valid header cannot exhaust memory.
+const maxProxyHeaderLength = 256
+
+var proxyV2Signature = []byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+var errProxyHeader = NewReportableStatus(StatusServiceNotAvailable, "malformed PROXY protocol header")
+
+// readProxyHeader peeks at the start of conn looking for a PROXY protocol
+// header matching s.ProxyProtocol, and returns a net.Conn whose RemoteAddr
+// reflects the real client address recovered from it. Connections bearing a
+// malformed, mismatched or oversized header are closed and an error is
+// returned instead. When Server.Timeout is set, a read deadline bounds the
+// whole operation so a peer that withholds the header cannot tie up the
+// caller indefinitely.
+func (s *Server) readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if s.Timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.Timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(conn)
+	signature, peekErr := reader.Peek(len(proxyV2Signature))
+	isV2 := peekErr == nil && bytes.Equal(signature, proxyV2Signature)
+	switch s.ProxyProtocol {
+	case ProxyProtocolV1:
+		if isV2 {
+			conn.Close()
+			return nil, errProxyHeader
+		}
+	case ProxyProtocolV2:
+		if !isV2 {
+			conn.Close()
+			return nil, errProxyHeader
+		}
+	}
+	var (
+		addr net.Addr
+		err  error
+	)
+	if isV2 {
+		addr, err = parseProxyV2(reader)
+	} else {
+		addr, err = parseProxyV1(reader)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: reader, remoteAddr: addr}, nil
+}
+
+// parseProxyV1 parses the text form of the header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 51234 25\r\n".
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := readProxyLine(r)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil {
+		return nil, errProxyHeader
+	}
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+// readProxyLine reads one CRLF-terminated line, one byte at a time, so a
+// client that never sends a terminator cannot make us buffer unboundedly.
+func readProxyLine(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for i := 0; i < maxProxyHeaderLength; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", errProxyHeader
+		}
+		if b == '\n' {
+			if len(buf) > 0 && buf[len(buf)-1] == '\r' {
+				buf = buf[:len(buf)-1]
+			}
+			return string(buf), nil
+		}
+		buf = append(buf, b)
+	}
+	return "", errProxyHeader
+}
+
+// parseProxyV2 parses the binary v2 header: a 12 byte signature, a
+// version/command byte, an address family/protocol byte, a big-endian
+// uint16 address-block length, and then the address block itself.
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errProxyHeader
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	command := header[12] & 0x0F
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if length > maxProxyHeaderLength {
+		return nil, errProxyHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errProxyHeader
+	}
+	if command == 0x00 { // LOCAL: health check, no real address to recover
+		return nil, nil
+	}
+	switch family {
+	case 0x11: // AF_INET, STREAM
+		if len(payload) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // AF_INET6, STREAM
+		if len(payload) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	case 0x31: // AF_UNIX, STREAM
+		if len(payload) < 216 {
+			return nil, errProxyHeader
+		}
+		return &net.UnixAddr{
+			Name: strings.TrimRight(string(payload[0:108]), "\x00"),
+			Net:  "unix",
+		}, nil
+	default:
+		return nil, errProxyHeader
+	}
+}
+
+// proxyConn wraps an accepted net.Conn so that reads continue from the
+// bufio.Reader used to parse the PROXY header (which may have buffered
+// bytes past it already), while RemoteAddr reports the real peer address
+// recovered from that header.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
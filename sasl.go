@@ -0,0 +1,114 @@
+package yetanothersmtpd
+
+import "bytes"
+
+// SASLCredential carries the verifier material SCRAMSHA256 needs to
+// authenticate a user per RFC 5802, without the cleartext password ever
+// needing to be known or transmitted server side.
+type SASLCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SASLMechanism is a pluggable SASL authentication mechanism. Begin is
+// called once per AUTH command to start an exchange; initialResponse is the
+// decoded initial-response data from the AUTH command line, or "" if the
+// client did not supply one.
+type SASLMechanism interface {
+	Begin(handler SessionHandler, initialResponse string) (SASLState, error)
+}
+
+// SASLState drives a single SASL exchange's challenge/response loop. Next is
+// called with the decoded client response -- for the very first call this
+// is Begin's initialResponse, which is "" if the client did not supply one;
+// later calls get whatever the client sends in reply to the previous
+// challenge. It returns whether the exchange is finished and, if not, the
+// next challenge to send.
+type SASLState interface {
+	Next(response string) (done bool, challenge string, err error)
+}
+
+// defaultAuthMechanisms is used whenever Server.AuthMechanisms is nil,
+// preserving the PLAIN/LOGIN-only behaviour this package has always had.
+var defaultAuthMechanisms = map[string]SASLMechanism{
+	"PLAIN": SASLPlain,
+	"LOGIN": SASLLogin,
+}
+
+func (s *Server) authMechanisms() map[string]SASLMechanism {
+	if s.AuthMechanisms != nil {
+		return s.AuthMechanisms
+	}
+	return defaultAuthMechanisms
+}
+
+// SASLPlain is the built-in RFC 4616 PLAIN mechanism.
+var SASLPlain SASLMechanism = saslPlainMechanism{}
+
+type saslPlainMechanism struct{}
+
+func (saslPlainMechanism) Begin(handler SessionHandler, initialResponse string) (SASLState, error) {
+	return &plainState{handler: handler}, nil
+}
+
+type plainState struct {
+	handler SessionHandler
+	started bool
+}
+
+func (p *plainState) Next(response string) (bool, string, error) {
+	if !p.started {
+		p.started = true
+		if response == "" {
+			return false, "", nil
+		}
+	}
+	parts := bytes.Split([]byte(response), []byte{0})
+	if len(parts) != 3 {
+		return false, "", ErrDecodingCredentials
+	}
+	if err := p.handler.Authenticate(string(parts[1]), string(parts[2])); err != nil {
+		return false, "", err
+	}
+	return true, "", nil
+}
+
+// SASLLogin is the built-in (non-standard but widely deployed) LOGIN
+// mechanism, prompting separately for a username then a password.
+var SASLLogin SASLMechanism = saslLoginMechanism{}
+
+type saslLoginMechanism struct{}
+
+func (saslLoginMechanism) Begin(handler SessionHandler, initialResponse string) (SASLState, error) {
+	return &loginState{handler: handler}, nil
+}
+
+type loginState struct {
+	handler  SessionHandler
+	username string
+	awaiting string // "", "username" or "password"
+}
+
+func (l *loginState) Next(response string) (bool, string, error) {
+	switch l.awaiting {
+	case "":
+		if response == "" {
+			l.awaiting = "username"
+			return false, "Username:", nil
+		}
+		l.username = response
+		l.awaiting = "password"
+		return false, "Password:", nil
+	case "username":
+		l.username = response
+		l.awaiting = "password"
+		return false, "Password:", nil
+	default: // "password"
+		if err := l.handler.Authenticate(l.username, response); err != nil {
+			return false, "", err
+		}
+		return true, "", nil
+	}
+}
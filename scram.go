@@ -0,0 +1,171 @@
+package yetanothersmtpd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// SCRAMSHA256 is the built-in RFC 5802 SCRAM-SHA-256 mechanism. It
+// authenticates via the handler's PasswordVerifierLookup, so the cleartext
+// password never crosses the wire or needs to be known server side.
+// SessionHandlers that do not implement PasswordVerifierLookup cannot
+// complete this mechanism; offer it via Server.AuthMechanisms only alongside
+// such a handler.
+var SCRAMSHA256 SASLMechanism = scramSHA256Mechanism{}
+
+type scramSHA256Mechanism struct{}
+
+func (scramSHA256Mechanism) Begin(handler SessionHandler, initialResponse string) (SASLState, error) {
+	return &scramState{handler: handler}, nil
+}
+
+type scramState struct {
+	handler SessionHandler
+	step    int
+
+	credential      SASLCredential
+	clientFirstBare string
+	serverNonce     string
+	serverFirst     string
+}
+
+func (s *scramState) Next(response string) (bool, string, error) {
+	switch s.step {
+	case 0:
+		if response == "" {
+			s.step = 1
+			return false, "", nil
+		}
+		return s.clientFirst(response)
+	case 1:
+		return s.clientFirst(response)
+	case 2:
+		return s.clientFinal(response)
+	default: // 3: client has acknowledged our server signature
+		return true, "", nil
+	}
+}
+
+func (s *scramState) clientFirst(msg string) (bool, string, error) {
+	if !strings.HasPrefix(msg, "n,,") {
+		return false, "", ErrDecodingCredentials
+	}
+	bare := strings.TrimPrefix(msg, "n,,")
+	attrs, err := parseSCRAMAttributes(bare)
+	if err != nil {
+		return false, "", err
+	}
+	username, ok := attrs["n"]
+	if !ok {
+		return false, "", ErrDecodingCredentials
+	}
+	clientNonce, ok := attrs["r"]
+	if !ok {
+		return false, "", ErrDecodingCredentials
+	}
+	lookup, ok := s.handler.(PasswordVerifierLookup)
+	if !ok {
+		return false, "", ErrSCRAMNotSupported
+	}
+	credential, err := lookup.LookupPasswordVerifier(username)
+	if err != nil {
+		return false, "", err
+	}
+	nonce, err := randomNonce()
+	if err != nil {
+		return false, "", err
+	}
+	s.credential = credential
+	s.clientFirstBare = bare
+	s.serverNonce = clientNonce + nonce
+	s.serverFirst = fmt.Sprintf(
+		"r=%s,s=%s,i=%d",
+		s.serverNonce,
+		base64.StdEncoding.EncodeToString(credential.Salt),
+		credential.Iterations,
+	)
+	s.step = 2
+	return false, s.serverFirst, nil
+}
+
+func (s *scramState) clientFinal(msg string) (bool, string, error) {
+	attrs, err := parseSCRAMAttributes(msg)
+	if err != nil {
+		return false, "", err
+	}
+	channelBinding, ok := attrs["c"]
+	if !ok || channelBinding != base64.StdEncoding.EncodeToString([]byte("n,,")) {
+		return false, "", ErrDecodingCredentials
+	}
+	nonce, ok := attrs["r"]
+	if !ok || nonce != s.serverNonce {
+		return false, "", ErrDecodingCredentials
+	}
+	proof, ok := attrs["p"]
+	if !ok {
+		return false, "", ErrDecodingCredentials
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil || len(clientProof) != sha256.Size {
+		return false, "", ErrDecodingCredentials
+	}
+	withoutProof := fmt.Sprintf("c=%s,r=%s", channelBinding, nonce)
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := hmacSHA256(s.credential.StoredKey, authMessage)
+	clientKey := xorBytes(clientProof, clientSignature)
+	storedKey := sha256Sum(clientKey)
+	if subtle.ConstantTimeCompare(storedKey, s.credential.StoredKey) != 1 {
+		return false, "", ErrDecodingCredentials
+	}
+	serverSignature := hmacSHA256(s.credential.ServerKey, authMessage)
+	s.step = 3
+	return false, "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// parseSCRAMAttributes splits a SCRAM comma-separated attribute list (e.g.
+// "r=foo,s=bar,i=4096") into a map keyed by the single-letter attribute
+// name. Values may themselves contain '=' (base64 padding), so only the
+// first '=' in each field is treated as the separator.
+func parseSCRAMAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		idx := strings.IndexByte(field, '=')
+		if idx < 0 {
+			return nil, ErrDecodingCredentials
+		}
+		attrs[field[:idx]] = field[idx+1:]
+	}
+	return attrs, nil
+}
+
+func randomNonce() (string, error) {
+	buf := make([]byte, 18)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
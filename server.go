@@ -1,12 +1,20 @@
 package yetanothersmtpd
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"net"
+	"net/textproto"
+	"sync"
 	"time"
 )
 
+// ErrServerClosed is returned by Serve after Shutdown or Close has been
+// called.
+var ErrServerClosed = errors.New("yetanothersmtpd: server closed")
+
 type Server struct {
 	Hostname        string
 	OnNewConnection func(peer net.Addr, isTLS bool) (SessionHandler, error)
@@ -14,34 +22,235 @@ type Server struct {
 	RequireTLS      bool
 	Timeout         time.Duration
 	TLSConfig       *tls.Config
+
+	// ProxyProtocol, when set to anything other than ProxyProtocolOff,
+	// requires every accepted connection to be preceded by a PROXY
+	// protocol header and recovers the real client address from it before
+	// invoking OnNewConnection.
+	ProxyProtocol ProxyProtocolMode
+
+	// MaxLineLength caps how many bytes a single command line may contain
+	// before the session is sent ErrLineTooLong instead of having the
+	// oversize line buffered in memory. Zero means unlimited.
+	MaxLineLength int
+
+	// MaxRecipients caps how many RCPT commands a single envelope may
+	// accumulate. Zero means unlimited.
+	MaxRecipients int
+
+	// MaxErrors caps how many soft (4xx/5xx) errors a session may receive
+	// before it is terminated with a 421. Zero means the default of 3.
+	MaxErrors int
+
+	// AuthMechanisms lists the SASL mechanisms advertised and accepted for
+	// AUTH, keyed by mechanism name (e.g. "PLAIN", "SCRAM-SHA-256"). A nil
+	// map falls back to PLAIN and LOGIN only.
+	AuthMechanisms map[string]SASLMechanism
+
+	// LMTP switches the server to RFC 2033 LMTP: the greeting requires
+	// LHLO rather than HELO/EHLO, and handleDATA reports one status per
+	// recipient rather than a single reply (see PerRecipientMessageHandler).
+	LMTP bool
+
+	// EnhancedStatusCodes advertises RFC 2034 ENHANCEDSTATUSCODES and
+	// prefixes replies with their RFC 3463 enhanced status code, for
+	// ReportableStatus values that set one.
+	EnhancedStatusCodes bool
+
+	// MaxConnections caps how many sessions may be live at once across the
+	// whole server. Zero means unlimited.
+	MaxConnections int
+
+	// MaxConnectionsPerSource caps how many sessions may be live at once
+	// per remote IP. Zero means unlimited.
+	MaxConnectionsPerSource int
+
+	mu        sync.Mutex
+	listener  net.Listener
+	closed    bool
+	wg        sync.WaitGroup
+	sessions  map[*session]struct{}
+	liveTotal int
+	perSource map[string]int
 }
 
 func (s *Server) Serve(listener net.Listener) error {
 	if s.OnNewConnection == nil {
 		return errors.New("new connection callback not be nil")
 	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				time.Sleep(time.Second)
 				continue
 			}
 			return err
 		}
-		handler, err := s.OnNewConnection(conn.RemoteAddr(), false)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleNewConnection(conn)
+		}()
+	}
+}
+
+// handleNewConnection resolves any PROXY protocol header, enforces the
+// connection caps and hands the connection to OnNewConnection, all off the
+// accept loop so a slow or silent peer can only ever stall its own
+// connection, never acceptance of everyone else's.
+func (s *Server) handleNewConnection(conn net.Conn) {
+	if s.ProxyProtocol != ProxyProtocolOff {
+		var err error
+		conn, err = s.readProxyHeader(conn)
 		if err != nil {
-			return err
+			return
+		}
+	}
+	if !s.acceptConnection(conn) {
+		return
+	}
+	defer s.releaseConnection(conn)
+	handler, err := s.OnNewConnection(conn.RemoteAddr(), false)
+	if err != nil {
+		return
+	}
+	if handler == nil {
+		// This must have been a conscious decision on the part of
+		// the OnNewConnection function so not treating that as an
+		// error. In fact, not even logging it since the
+		// OnNewConnection callback is perfectly capable of doing
+		// that.
+		return
+	}
+	sn := newSession(s, handler, conn, false)
+	s.trackSession(sn)
+	defer s.untrackSession(sn)
+	sn.serve()
+}
+
+// Shutdown gracefully stops the server: it stops accepting new connections,
+// tells idle sessions to hang up with a 421, and waits for in-flight
+// handleDATA calls to finish before returning, unless ctx expires first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	idle := s.idleSessions()
+	for _, sn := range idle {
+		sn.shutdownNow()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately: it stops accepting new connections
+// and closes the listener without waiting for in-flight sessions to finish.
+func (s *Server) Close() error {
+	return s.stop()
+}
+
+// stop marks the server closed and closes its listener, once.
+func (s *Server) stop() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	listener := s.listener
+	s.mu.Unlock()
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+func (s *Server) idleSessions() []*session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idle := make([]*session, 0, len(s.sessions))
+	for sn := range s.sessions {
+		if !sn.inData() {
+			idle = append(idle, sn)
 		}
-		if handler == nil {
-			// This must have been a conscious decision on the
-			// part of the OnNewConnection function so not treating
-			// that as an error. In fact, not even logging it since
-			// the OnNewConnection callback is perfectly capable of
-			// doing that.
-			continue
+	}
+	return idle
+}
+
+func (s *Server) trackSession(sn *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[*session]struct{})
+	}
+	s.sessions[sn] = struct{}{}
+}
+
+func (s *Server) untrackSession(sn *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sn)
+}
+
+// acceptConnection enforces MaxConnections/MaxConnectionsPerSource, closing
+// and rejecting conn with a 421 if the relevant cap has been reached.
+func (s *Server) acceptConnection(conn net.Conn) bool {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	s.mu.Lock()
+	over := (s.MaxConnections > 0 && s.liveTotal >= s.MaxConnections) ||
+		(s.MaxConnectionsPerSource > 0 && s.perSource[host] >= s.MaxConnectionsPerSource)
+	if !over {
+		s.liveTotal++
+		if s.perSource == nil {
+			s.perSource = make(map[string]int)
 		}
-		sn := newSession(s, handler, conn, false)
-		go sn.serve()
+		s.perSource[host]++
+	}
+	s.mu.Unlock()
+	if over {
+		rejectConnection(conn)
+		return false
+	}
+	return true
+}
+
+// rejectConnection tells a connection it's over one of the server's
+// connection caps, then closes it.
+func rejectConnection(conn net.Conn) {
+	writer := textproto.NewWriter(bufio.NewWriter(conn))
+	writer.PrintfLine("%d Too many connections", StatusServiceNotAvailable)
+	conn.Close()
+}
+
+func (s *Server) releaseConnection(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveTotal--
+	if s.perSource[host] <= 1 {
+		delete(s.perSource, host)
+	} else {
+		s.perSource[host]--
 	}
 }
@@ -2,14 +2,17 @@ package yetanothersmtpd
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,9 +21,11 @@ type operationHandler func(*session, command) error
 var (
 	operationHandlers = map[string]operationHandler{
 		"AUTH":     (*session).handleAUTH,
+		"BDAT":     (*session).handleBDAT,
 		"DATA":     (*session).handleDATA,
 		"EHLO":     (*session).handleEHLO,
 		"HELO":     (*session).handleHELO,
+		"LHLO":     (*session).handleLHLO,
 		"MAIL":     (*session).handleMAIL,
 		"NOOP":     (*session).handleNOOP,
 		"QUIT":     (*session).handleQUIT,
@@ -28,51 +33,109 @@ var (
 		"RSET":     (*session).handleRSET,
 		"STARTTLS": (*session).handleSTARTTLS,
 	}
-
-	authMap = map[string]operationHandler{
-		"LOGIN": (*session).authLOGIN,
-		"PLAIN": (*session).authPLAIN,
-	}
 )
 
 type session struct {
-	server    *Server
-	sHandler  SessionHandler
-	mHandler  MessageHandler
-	conn      net.Conn
-	gotHelo   bool
-	isTLS     bool
-	keepGoing bool
+	server     *Server
+	sHandler   SessionHandler
+	mHandler   MessageHandler
+	dataWriter io.WriteCloser
+	conn       net.Conn
+	gotHelo    bool
+	isTLS      bool
+	keepGoing  bool
+	errCount   int
+	rcptCount  int
+	receiving  int32 // set via atomic, 1 while a DATA/BDAT transfer is in flight
 
-	reader  *textproto.Reader
-	writer  *textproto.Writer
-	scanner *bufio.Scanner
+	reader      *textproto.Reader
+	writer      *textproto.Writer
+	writerMu    sync.Mutex // guards writer, since shutdownNow may write from outside the session's own goroutine
+	scanner     *bufio.Scanner
+	lineLimiter *lineLimitReader // nil unless Server.MaxLineLength is set
 }
 
 func newSession(server *Server, handler SessionHandler, conn net.Conn, isTLS bool) *session {
+	var reader io.Reader = conn
+	var limiter *lineLimitReader
+	if server.MaxLineLength > 0 {
+		limiter = newLineLimitReader(conn, server.MaxLineLength)
+		reader = limiter
+	}
 	return &session{
-		server:    server,
-		sHandler:  handler,
-		conn:      conn,
-		gotHelo:   false,
-		isTLS:     isTLS,
-		keepGoing: true,
-		reader:    textproto.NewReader(bufio.NewReader(conn)),
-		writer:    textproto.NewWriter(bufio.NewWriter(conn)),
+		server:      server,
+		sHandler:    handler,
+		conn:        conn,
+		gotHelo:     false,
+		isTLS:       isTLS,
+		keepGoing:   true,
+		reader:      textproto.NewReader(bufio.NewReader(reader)),
+		writer:      textproto.NewWriter(bufio.NewWriter(conn)),
+		lineLimiter: limiter,
 	}
 }
 
+// setLineLimitEnabled toggles MaxLineLength enforcement, if configured, for
+// the duration of a DATA/BDAT transfer, whose payload routinely contains
+// lines (or arbitrary binary) longer than any sane command-line limit.
+func (s *session) setLineLimitEnabled(enabled bool) {
+	if s.lineLimiter != nil {
+		s.lineLimiter.setEnabled(enabled)
+	}
+}
+
+// inData reports whether this session is currently streaming message data
+// via DATA or BDAT, i.e. whether it is unsafe for Shutdown to interrupt it.
+func (s *session) inData() bool {
+	return atomic.LoadInt32(&s.receiving) != 0
+}
+
+// shutdownNow is called by Server.Shutdown on sessions found idle (not
+// mid-transfer): it reports 4.7.0 and forcibly closes the connection,
+// unblocking the session's goroutine out of its blocking read.
+func (s *session) shutdownNow() {
+	s.writeLine("%d 4.7.0 Server shutting down", StatusServiceNotAvailable)
+	s.conn.Close()
+}
+
+// writeLine writes a single reply line, holding writerMu so it cannot
+// interleave with a reply written concurrently by shutdownNow.
+func (s *session) writeLine(format string, args ...interface{}) error {
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+	return s.writer.PrintfLine(format, args...)
+}
+
+// maxErrors returns the configured soft-error threshold, defaulting to 3.
+func (s *session) maxErrors() int {
+	if s.server.MaxErrors > 0 {
+		return s.server.MaxErrors
+	}
+	return 3
+}
+
 func (s *session) serve() {
 	defer s.closeOrReport(s.conn)
-	err := s.writer.PrintfLine("%d %s ESMTP ready", StatusServiceReady, s.server.Hostname)
+	protocol := "ESMTP"
+	if s.server.LMTP {
+		protocol = "LMTP"
+	}
+	err := s.writeLine("%d %s %s ready", StatusServiceReady, s.server.Hostname, protocol)
 	if err != nil {
 		s.sHandler.HandleSessionError(err)
 		return
 	}
-	for {
-		if s.keepGoing {
-			s.serveOne()
+	for s.keepGoing {
+		s.server.mu.Lock()
+		closed := s.server.closed
+		s.server.mu.Unlock()
+		if closed {
+			// The server was shut down while this session was busy (e.g.
+			// in DATA/BDAT); hang up rather than serve further commands.
+			s.handleError(s.writeLine("%d 4.7.0 Server shutting down", StatusServiceNotAvailable))
+			return
 		}
+		s.serveOne()
 	}
 }
 
@@ -107,13 +170,48 @@ func (s *session) handleError(err error) {
 	}
 	rErr, isStatus := err.(*ReportableStatus)
 	if isStatus {
-		s.handleError(s.writer.PrintfLine("%d %s", rErr.Code, rErr.Message))
+		if rErr.Code >= 400 {
+			s.errCount++
+		}
+		if s.errCount > s.maxErrors() {
+			s.keepGoing = false
+			s.handleError(s.writeStatus(&ReportableStatus{
+				Code:         StatusServiceNotAvailable,
+				Message:      "Too many errors",
+				EnhancedCode: "4.3.0",
+			}))
+			return
+		}
+		s.handleError(s.writeStatus(rErr))
 		return
 	}
 	s.keepGoing = false
 	s.sHandler.HandleSessionError(err)
 }
 
+// writeStatus renders rErr as one or more SMTP reply lines, using "nnn-"
+// continuation lines for all but the last (RFC 5321 4.2.1) and prefixing
+// each with its enhanced status code when the server advertises
+// ENHANCEDSTATUSCODES.
+func (s *session) writeStatus(rErr *ReportableStatus) error {
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+	lines := rErr.lines()
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		if s.server.EnhancedStatusCodes && rErr.EnhancedCode != "" {
+			line = rErr.EnhancedCode + " " + line
+		}
+		if err := s.writer.PrintfLine("%d%s%s", rErr.Code, separator, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *session) handleAUTH(cmd command) error {
 	if !s.gotHelo {
 		return ErrNoHelo
@@ -121,18 +219,108 @@ func (s *session) handleAUTH(cmd command) error {
 	if len(cmd.fields) < 2 {
 		return ErrInvalidSyntax
 	}
-	mechanism := strings.ToUpper(cmd.fields[1])
-	action, exists := authMap[mechanism]
+	mechanism, exists := s.server.authMechanisms()[strings.ToUpper(cmd.fields[1])]
 	if !exists {
 		return NewReportableStatus(
 			StatusCommandNotImplemented,
 			"Unknown authentication mechanism",
 		)
 	}
-	return action(s, cmd)
+	initialResponse := ""
+	if len(cmd.fields) > 2 {
+		decoded, err := base64.StdEncoding.DecodeString(cmd.fields[2])
+		if err != nil {
+			return ErrDecodingCredentials
+		}
+		initialResponse = string(decoded)
+	}
+	state, err := mechanism.Begin(s.sHandler, initialResponse)
+	if err != nil {
+		return err
+	}
+	response := initialResponse
+	for {
+		done, challenge, err := state.Next(response)
+		if err != nil {
+			return err
+		}
+		if done {
+			return AuthSuccess
+		}
+		err = s.writeLine(
+			"%d %s", StatusProvideCredentials,
+			base64.StdEncoding.EncodeToString([]byte(challenge)),
+		)
+		if err != nil {
+			return err
+		}
+		line, err := s.reader.ReadLine()
+		if err != nil {
+			return err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return ErrDecodingCredentials
+		}
+		response = string(decoded)
+	}
+}
+
+// handleBDAT implements RFC 3030 CHUNKING. Each BDAT command carries the
+// exact byte count that follows it on the wire, which is streamed straight
+// into the current MessageHandler's io.WriteCloser -- obtained lazily on the
+// first chunk -- avoiding the dot-stuffing DATA requires. The transfer is
+// finalized once a chunk is marked LAST.
+func (s *session) handleBDAT(cmd command) error {
+	if s.mHandler == nil {
+		return ErrBadSequence
+	}
+	if len(cmd.fields) < 2 {
+		return ErrInvalidSyntax
+	}
+	size, err := strconv.ParseUint(cmd.fields[1], 10, 32)
+	if err != nil {
+		return ErrInvalidSyntax
+	}
+	last := false
+	if len(cmd.fields) > 2 {
+		if !strings.EqualFold(cmd.fields[2], "LAST") {
+			return ErrInvalidSyntax
+		}
+		last = true
+	}
+	if s.dataWriter == nil {
+		writeCloser, err := s.mHandler.GetDataWriter()
+		if err != nil {
+			return err
+		}
+		s.dataWriter = writeCloser
+	}
+	if size > 0 {
+		atomic.StoreInt32(&s.receiving, 1)
+		s.setLineLimitEnabled(false)
+		_, err := io.CopyN(s.dataWriter, s.reader.R, int64(size))
+		s.setLineLimitEnabled(true)
+		atomic.StoreInt32(&s.receiving, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if !last {
+		return NewReportableStatus(StatusOK, "%d bytes received", size)
+	}
+	if err := s.dataWriter.Close(); err != nil {
+		return err
+	}
+	s.dataWriter = nil
+	s.mHandler = nil // this is the end of the current message
+	return ThankYou
 }
 
 func (s *session) handleDATA(cmd command) error {
+	if s.dataWriter != nil {
+		return ErrBadSequence
+	}
 	if s.mHandler == nil {
 		return ErrBadSequence
 	}
@@ -140,7 +328,7 @@ func (s *session) handleDATA(cmd command) error {
 	if err != nil {
 		return err
 	}
-	err = s.writer.PrintfLine(
+	err = s.writeLine(
 		"%d Go ahead. End your data with <CR><LF>.<CR><LF>",
 		StatusStartMailInput,
 	)
@@ -148,42 +336,71 @@ func (s *session) handleDATA(cmd command) error {
 		return err
 	}
 	dotReader := s.reader.DotReader()
-	if _, err := io.Copy(writeCloser, dotReader); err != nil {
+	atomic.StoreInt32(&s.receiving, 1)
+	s.setLineLimitEnabled(false)
+	_, err = io.Copy(writeCloser, dotReader)
+	s.setLineLimitEnabled(true)
+	atomic.StoreInt32(&s.receiving, 0)
+	if err != nil {
 		return err
 	}
 	if err := writeCloser.Close(); err != nil {
 		return err
 	}
+	mHandler := s.mHandler
 	s.mHandler = nil // this is the end of the current message
+	if s.server.LMTP {
+		return s.reportPerRecipientStatuses(mHandler)
+	}
 	return ThankYou
 }
 
+// reportPerRecipientStatuses implements the LMTP half of handleDATA: if
+// mHandler opted into PerRecipientMessageHandler, every status but the last
+// is written out as its own reply, and the last is returned so the usual
+// handleError path writes and counts it like any other response.
+func (s *session) reportPerRecipientStatuses(mHandler MessageHandler) error {
+	perRecipient, ok := mHandler.(PerRecipientMessageHandler)
+	if !ok {
+		return ThankYou
+	}
+	statuses := perRecipient.DeliverPerRecipient()
+	if len(statuses) == 0 {
+		return ThankYou
+	}
+	for _, status := range statuses[:len(statuses)-1] {
+		if err := s.writeStatus(status); err != nil {
+			return err
+		}
+	}
+	return statuses[len(statuses)-1]
+}
+
 func (s *session) handleEHLO(cmd command) error {
+	if s.server.LMTP {
+		return NewReportableStatus(StatusCommandNotImplemented, "Please use LHLO")
+	}
 	if len(cmd.fields) < 2 {
 		return ErrInvalidSyntax
 	}
 	s.mHandler = nil // reset message in case of duplicate HELO
+	s.dataWriter = nil
 	if err := s.sHandler.HandleHELO(cmd.fields[1], true); err != nil {
 		return err
 	}
-	extensions := s.extensions()
-	if len(extensions) > 1 {
-		for _, ext := range extensions[:len(extensions)-1] {
-			err := s.writer.PrintfLine("%d-%s", StatusOK, ext)
-			if err != nil {
-				return err
-			}
-		}
-	}
 	s.gotHelo = true
-	return NewReportableStatus(StatusOK, extensions[len(extensions)-1])
+	return &ReportableStatus{Code: StatusOK, Lines: s.extensions()}
 }
 
 func (s *session) handleHELO(cmd command) error {
+	if s.server.LMTP {
+		return NewReportableStatus(StatusCommandNotImplemented, "Please use LHLO")
+	}
 	if len(cmd.fields) < 2 {
 		return ErrInvalidSyntax
 	}
 	s.mHandler = nil // reset message in case of duplicate HELO
+	s.dataWriter = nil
 	if err := s.sHandler.HandleHELO(cmd.fields[1], false); err != nil {
 		return err
 	}
@@ -191,6 +408,23 @@ func (s *session) handleHELO(cmd command) error {
 	return GoAhead
 }
 
+// handleLHLO is the LMTP (RFC 2033) equivalent of handleEHLO.
+func (s *session) handleLHLO(cmd command) error {
+	if !s.server.LMTP {
+		return NewReportableStatus(StatusCommandNotImplemented, "Unsupported command")
+	}
+	if len(cmd.fields) < 2 {
+		return ErrInvalidSyntax
+	}
+	s.mHandler = nil // reset message in case of duplicate LHLO
+	s.dataWriter = nil
+	if err := s.sHandler.HandleHELO(cmd.fields[1], true); err != nil {
+		return err
+	}
+	s.gotHelo = true
+	return &ReportableStatus{Code: StatusOK, Lines: s.extensions()}
+}
+
 func (s *session) handleMAIL(cmd command) error {
 	if !s.gotHelo {
 		return ErrNoHelo
@@ -208,6 +442,8 @@ func (s *session) handleMAIL(cmd command) error {
 		return err
 	}
 	s.mHandler = mHandler
+	s.dataWriter = nil
+	s.rcptCount = 0
 	return GoAhead
 }
 
@@ -224,6 +460,9 @@ func (s *session) handleRCPT(cmd command) error {
 	if s.mHandler == nil {
 		return ErrBadSequence
 	}
+	if s.server.MaxRecipients > 0 && s.rcptCount >= s.server.MaxRecipients {
+		return ErrTooManyRecipients
+	}
 	recipient, err := parseAddress(cmd.params[1])
 	if err != nil {
 		return err
@@ -231,11 +470,14 @@ func (s *session) handleRCPT(cmd command) error {
 	if err := s.mHandler.AddRecipient(recipient); err != nil {
 		return err
 	}
+	s.rcptCount++
 	return GoAhead
 }
 
 func (s *session) handleRSET(cmd command) error {
 	s.mHandler = nil
+	s.dataWriter = nil
+	s.rcptCount = 0
 	return GoAhead
 }
 
@@ -247,7 +489,7 @@ func (s *session) handleSTARTTLS(cmd command) error {
 		return NewReportableStatus(StatusCommandNotImplemented, "TLS not supported")
 	}
 	tlsConn := tls.Server(s.conn, s.server.TLSConfig)
-	if err := s.writer.PrintfLine("%d Go ahead", StatusOK); err != nil {
+	if err := s.writeLine("%d Go ahead", StatusOK); err != nil {
 		return err
 	}
 	s.conn.SetDeadline(time.Time{})
@@ -259,70 +501,28 @@ func (s *session) handleSTARTTLS(cmd command) error {
 	return nil
 }
 
-func (s *session) authLOGIN(cmd command) error {
-	err := s.writer.PrintfLine("%d VXNlcm5hbWU6", StatusProvideCredentials)
-	if err != nil {
-		return err
-	}
-	line, err := s.reader.ReadLine()
-	if err != nil {
-		return err
-	}
-	byteUsername, err := base64.StdEncoding.DecodeString(line)
-	if err != nil {
-		return ErrDecodingCredentials
-	}
-	err = s.writer.PrintfLine("%d UGFzc3dvcmQ6", StatusProvideCredentials)
-	if err != nil {
-		return err
-	}
-	line, err = s.reader.ReadLine()
-	if err != nil {
-		return err
-	}
-	bytePassword, err := base64.StdEncoding.DecodeString(line)
-	if err != nil {
-		return ErrDecodingCredentials
-	}
-	return s.sHandler.Authenticate(string(byteUsername), string(bytePassword))
-}
-
-func (s *session) authPLAIN(cmd command) error {
-	auth := ""
-	if len(cmd.fields) < 3 {
-		err := s.writer.PrintfLine("%d Give me your credentials", StatusProvideCredentials)
-		if err != nil {
-			return err
-		}
-		auth, err = s.reader.ReadLine()
-		if err != nil {
-			return err
-		}
-	} else {
-		auth = cmd.fields[2]
-	}
-	data, err := base64.StdEncoding.DecodeString(auth)
-	if err != nil {
-		return ErrDecodingCredentials
-	}
-	parts := bytes.Split(data, []byte{0})
-	if len(parts) != 3 {
-		return ErrDecodingCredentials
-	}
-	return s.sHandler.Authenticate(string(parts[1]), string(parts[2]))
-}
-
 func (s *session) extensions() []string {
 	extensions := []string{
 		fmt.Sprintf("%d SIZE", s.sHandler.MaxMessageSize()),
 		"8BITMIME",
 		"PIPELINING",
+		"CHUNKING",
+		"BINARYMIME",
 	}
 	if s.server.TLSConfig != nil && !s.isTLS {
 		extensions = append(extensions, "STARTTLS")
 	}
 	if s.server.RequireAuth {
-		extensions = append(extensions, "AUTH PLAIN LOGIN")
+		mechanisms := s.server.authMechanisms()
+		names := make([]string, 0, len(mechanisms))
+		for name := range mechanisms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		extensions = append(extensions, "AUTH "+strings.Join(names, " "))
+	}
+	if s.server.EnhancedStatusCodes {
+		extensions = append(extensions, "ENHANCEDSTATUSCODES")
 	}
 	return extensions
 }
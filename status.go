@@ -40,24 +40,33 @@ const (
 )
 
 var (
-	AuthSuccess = NewReportableStatus(StatusAuthenticated, "OK, you are now authenticated")
-	GoAhead     = NewReportableStatus(StatusOK, "Go ahead")
-	ThankYou    = NewReportableStatus(StatusOK, "Thank you")
+	AuthSuccess = &ReportableStatus{Code: StatusAuthenticated, Message: "OK, you are now authenticated", EnhancedCode: "2.7.0"}
+	GoAhead     = &ReportableStatus{Code: StatusOK, Message: "Go ahead", EnhancedCode: "2.0.0"}
+	ThankYou    = &ReportableStatus{Code: StatusOK, Message: "Thank you", EnhancedCode: "2.6.0"}
 
-	ErrBadSequence         = NewReportableStatus(StatusBadSequence, "Invalid command sequence")
-	ErrDecodingCredentials = NewReportableStatus(StatusSyntaxError, "Couldn't decode your credentials")
-	ErrInvalidSyntax       = NewReportableStatus(StatusSyntaxError, "Invalid syntax")
-	ErrMalformedEmail      = NewReportableStatus(StatusSyntaxError, "Malformed email address")
-	ErrNoHelo              = NewReportableStatus(StatusBadSequence, "Please introduce yourself first")
+	ErrBadSequence         = &ReportableStatus{Code: StatusBadSequence, Message: "Invalid command sequence", EnhancedCode: "5.5.1"}
+	ErrDecodingCredentials = &ReportableStatus{Code: StatusSyntaxError, Message: "Couldn't decode your credentials", EnhancedCode: "5.5.2"}
+	ErrInvalidSyntax       = &ReportableStatus{Code: StatusSyntaxError, Message: "Invalid syntax", EnhancedCode: "5.5.2"}
+	ErrMalformedEmail      = &ReportableStatus{Code: StatusSyntaxError, Message: "Malformed email address", EnhancedCode: "5.1.3"}
+	ErrNoHelo              = &ReportableStatus{Code: StatusBadSequence, Message: "Please introduce yourself first", EnhancedCode: "5.5.1"}
+	ErrLineTooLong         = &ReportableStatus{Code: StatusCommandUnrecognized, Message: "Line too long", EnhancedCode: "5.2.3"}
+	ErrTooManyRecipients   = &ReportableStatus{Code: StatusInsufficientStorage, Message: "Too many recipients", EnhancedCode: "4.5.3"}
+	ErrSCRAMNotSupported   = &ReportableStatus{Code: StatusAccessDenied, Message: "SCRAM-SHA-256 not supported", EnhancedCode: "5.7.4"}
 )
 
 // ReportableStatus is a trivial implementation of 'error' interface. It does
 // not necessarily mean an Error though, but allows to differentiate between
 // reportable and non-reportable events. Some of the former might just as well
 // be success events.
+//
+// EnhancedCode, if set, is an RFC 3463 enhanced status code (e.g. "5.7.1")
+// rendered alongside Code. Lines, if set, lets a single reply span multiple
+// SMTP response lines (RFC 5321 4.2.1) instead of just Message.
 type ReportableStatus struct {
-	Code    StatusCode
-	Message string
+	Code         StatusCode
+	Message      string
+	EnhancedCode string
+	Lines        []string
 }
 
 // NewReportableStatus provides a helper function for creating instances of
@@ -69,6 +78,22 @@ func NewReportableStatus(code StatusCode, format string, args ...interface{}) er
 	}
 }
 
+// NewEnhancedStatus is like NewReportableStatus but additionally attaches an
+// RFC 3463 enhanced status code and lets the reply span multiple lines, one
+// per element of lines.
+func NewEnhancedStatus(code StatusCode, enhancedCode string, lines ...string) error {
+	return &ReportableStatus{Code: code, EnhancedCode: enhancedCode, Lines: lines}
+}
+
+// lines returns the reply's body lines, falling back to Message when Lines
+// was not set.
+func (r *ReportableStatus) lines() []string {
+	if len(r.Lines) > 0 {
+		return r.Lines
+	}
+	return []string{r.Message}
+}
+
 func (r *ReportableStatus) Error() string {
-	return fmt.Sprintf("%d %s", r.Code, r.Message)
+	return fmt.Sprintf("%d %s", r.Code, r.lines()[0])
 }
@@ -0,0 +1,45 @@
+package yetanothersmtpd
+
+import "strings"
+
+// XOAUTH2 is the built-in XOAUTH2 mechanism used by OAuth2-based clients
+// (Gmail, Outlook, ...). The client presents a single blob of the form
+// "user=<user>\x01auth=Bearer <token>\x01\x01", which is handed to
+// SessionHandler.Authenticate as the username/password pair.
+var XOAUTH2 SASLMechanism = xoauth2Mechanism{}
+
+type xoauth2Mechanism struct{}
+
+func (xoauth2Mechanism) Begin(handler SessionHandler, initialResponse string) (SASLState, error) {
+	return &xoauth2State{handler: handler}, nil
+}
+
+type xoauth2State struct {
+	handler SessionHandler
+	started bool
+}
+
+func (x *xoauth2State) Next(response string) (bool, string, error) {
+	if !x.started {
+		x.started = true
+		if response == "" {
+			return false, "", nil
+		}
+	}
+	var username, token string
+	for _, part := range strings.Split(response, "\x01") {
+		switch {
+		case strings.HasPrefix(part, "user="):
+			username = strings.TrimPrefix(part, "user=")
+		case strings.HasPrefix(part, "auth=Bearer "):
+			token = strings.TrimPrefix(part, "auth=Bearer ")
+		}
+	}
+	if username == "" || token == "" {
+		return false, "", ErrDecodingCredentials
+	}
+	if err := x.handler.Authenticate(username, token); err != nil {
+		return false, "", err
+	}
+	return true, "", nil
+}